@@ -0,0 +1,204 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !legacy_ldb
+// +build !legacy_ldb
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/database"
+	"github.com/btcsuite/btcd/database/ffldb"
+
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcutil"
+	"github.com/conformal/btcwire"
+)
+
+// chainDb is the slice of block-store functionality getSignatures, calcSighash
+// and search need: tip lookup, height->hash, and hash->block/tx. It's backed
+// by database.DB (ffldb) here; see db_legacy.go for the -tags legacy_ldb
+// build that talks to pre-ffldb datadirs instead.
+//
+// database.Tx itself only hands back raw block bytes (FetchBlock) and has no
+// notion of height or chain tip; those come from blockchain.BlockChain, which
+// indexes the same db and only ever deals in chainhash.Hash. Block and tx
+// bytes are deserialized by hand into conformal's own *btcwire.MsgBlock /
+// *btcwire.MsgTx rather than taking whatever type blockchain would hand back,
+// so this stays in the same type universe as btcec/btcscript/btcutil, which
+// getSignatures and calcSighash already depend on.
+type chainDb interface {
+	NewestHash() (*chainhash.Hash, int64, error)
+	FetchBlockHashByHeight(height int64) (*chainhash.Hash, error)
+	FetchBlockByHash(hash *chainhash.Hash) (*btcwire.MsgBlock, error)
+	FetchTxByHash(hash *chainhash.Hash, heightHint int64) (*btcwire.MsgTx, error)
+	Close() error
+}
+
+type ffldbChainDb struct {
+	db    database.DB
+	chain *blockchain.BlockChain
+}
+
+// btcdbSetup opens the on-disk block database and wires up logging for it.
+// Calling ffldb.OpenDB directly, instead of the string-keyed
+// database.Open(dbType, ...) + blank-import-for-side-effects dance, keeps the
+// backend actually in use visible at the call site.
+func btcdbSetup(dataDir, dbType string) (log btclog.Logger, db chainDb, cleanup func()) {
+	// Setup logging
+	backendLogger := btclog.NewDefaultBackendLogger()
+	log = btclog.NewSubsystemLogger(backendLogger, "")
+	database.UseLogger(log)
+
+	// Setup database access
+	dbPath := filepath.Join(dataDir, "mainnet", "blocks_"+dbType)
+
+	log.Infof("loading db %v", dbType)
+	backend, err := ffldb.OpenDB(dbPath, btcwire.MainNet, true)
+	if err != nil {
+		log.Warnf("db open failed: %v", err)
+		return
+	}
+
+	// database.Tx has no height index or chain-tip notion of its own; those
+	// live in the block index blockchain.BlockChain builds over the same db,
+	// so open one read-only rather than reinventing that index here.
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:          backend,
+		ChainParams: &chaincfg.MainNetParams,
+	})
+	if err != nil {
+		log.Warnf("blockchain.New failed: %v", err)
+		backend.Close()
+		return
+	}
+	log.Infof("db load complete")
+
+	db = &ffldbChainDb{db: backend, chain: chain}
+	cleanup = func() {
+		db.Close()
+		backendLogger.Flush()
+	}
+
+	return
+}
+
+func (c *ffldbChainDb) NewestHash() (*chainhash.Hash, int64, error) {
+	tip := c.chain.BestSnapshot()
+	return &tip.Hash, int64(tip.Height), nil
+}
+
+func (c *ffldbChainDb) FetchBlockHashByHeight(height int64) (*chainhash.Hash, error) {
+	return c.chain.BlockHashByHeight(int32(height))
+}
+
+// fetchRaw pulls a block's serialized bytes straight off the db. It
+// deliberately never touches a btcsuite wire.MsgBlock - only the bytes - so
+// the caller can deserialize with conformal's own btcwire instead.
+func (c *ffldbChainDb) fetchRaw(hash *chainhash.Hash) (raw []byte, err error) {
+	err = c.db.View(func(tx database.Tx) error {
+		raw, err = tx.FetchBlock(hash)
+		return err
+	})
+	return
+}
+
+func (c *ffldbChainDb) FetchBlockByHash(hash *chainhash.Hash) (*btcwire.MsgBlock, error) {
+	raw, err := c.fetchRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	blk := &btcwire.MsgBlock{}
+	if err := blk.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+// FetchTxByHash has no index to consult - database.Tx only knows about whole
+// blocks, and building/maintaining a real tx index is a blockchain.Indexers
+// concern this tool doesn't otherwise need - so it walks blocks looking for
+// hash in their transactions. That's only affordable because calcSighash no
+// longer calls this for every signature in the chain: it only runs from
+// recoverKeys, for the R values potentialValues has already flagged as a
+// real duplicate.
+//
+// heightHint is recoverKeys' best guess at hash's block height - the signing
+// tx's own height for itself, and again for its prevout, which can only be
+// at or before it. The walk checks heightHint first, then expands outward
+// from it a block at a time, rather than always starting over at genesis:
+// the common case of a prevout confirmed not long before it's spent comes
+// back fast, and the worst case (hash nowhere near heightHint) costs no more
+// than the unhinted walk did.
+func (c *ffldbChainDb) FetchTxByHash(hash *chainhash.Hash, heightHint int64) (*btcwire.MsgTx, error) {
+	target, err := btcwire.NewShaHash(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, tipHeight, err := c.NewestHash()
+	if err != nil {
+		return nil, err
+	}
+	if heightHint < 0 {
+		heightHint = 0
+	}
+	if heightHint > tipHeight {
+		heightHint = tipHeight
+	}
+
+	checkHeight := func(h int64) (*btcwire.MsgTx, error) {
+		blockHash, err := c.FetchBlockHashByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		blk, err := c.FetchBlockByHash(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range blk.Transactions {
+			if btcutil.NewTx(tx).Sha().IsEqual(target) {
+				return tx, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if tx, err := checkHeight(heightHint); err != nil {
+		return nil, err
+	} else if tx != nil {
+		return tx, nil
+	}
+
+	for delta := int64(1); heightHint-delta >= 0 || heightHint+delta <= tipHeight; delta++ {
+		if h := heightHint - delta; h >= 0 {
+			if tx, err := checkHeight(h); err != nil {
+				return nil, err
+			} else if tx != nil {
+				return tx, nil
+			}
+		}
+		if h := heightHint + delta; h <= tipHeight {
+			if tx, err := checkHeight(h); err != nil {
+				return nil, err
+			} else if tx != nil {
+				return tx, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("tx %v not found in chain", hash)
+}
+
+func (c *ffldbChainDb) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build legacy_ldb
+// +build legacy_ldb
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+
+	"github.com/conformal/btcdb"
+	"github.com/conformal/btcdb/ldb"
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcwire"
+)
+
+// legacyChainDb adapts the pre-ffldb conformal/btcdb leveldb driver onto
+// chainDb, for datadirs written by btcd versions that predate the ffldb
+// format. Only built in with `-tags legacy_ldb`; the default build in db.go
+// only understands ffldb.
+type legacyChainDb struct {
+	db btcdb.Db
+}
+
+// btcdbSetup opens a legacy leveldb datadir via ldb.OpenDB directly, rather
+// than btcdb.OpenDB(dbType, ...) plus a blank import of btcdb/ldb for its
+// registration side effect.
+func btcdbSetup(dataDir, dbType string) (log btclog.Logger, db chainDb, cleanup func()) {
+	// Setup logging
+	backendLogger := btclog.NewDefaultBackendLogger()
+	log = btclog.NewSubsystemLogger(backendLogger, "")
+	btcdb.UseLogger(log)
+
+	// Setup database access
+	dbPath := filepath.Join(dataDir, "mainnet", "blocks_"+dbType)
+
+	log.Infof("loading legacy db %v", dbType)
+	backend, err := ldb.OpenDB(dbPath)
+	if err != nil {
+		log.Warnf("db open failed: %v", err)
+		return
+	}
+	log.Infof("db load complete")
+
+	db = &legacyChainDb{db: backend}
+	cleanup = func() {
+		db.Close()
+		backendLogger.Flush()
+	}
+
+	return
+}
+
+func (c *legacyChainDb) NewestHash() (*chainhash.Hash, int64, error) {
+	sha, height, err := c.db.NewestSha()
+	if err != nil {
+		return nil, 0, err
+	}
+	hash, err := chainhash.NewHash(sha[:])
+	return hash, height, err
+}
+
+func (c *legacyChainDb) FetchBlockHashByHeight(height int64) (*chainhash.Hash, error) {
+	sha, err := c.db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHash(sha[:])
+}
+
+func (c *legacyChainDb) FetchBlockByHash(hash *chainhash.Hash) (*btcwire.MsgBlock, error) {
+	sha, err := btcwire.NewShaHash(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	blk, err := c.db.FetchBlockBySha(sha)
+	if err != nil {
+		return nil, err
+	}
+	return blk.MsgBlock(), nil
+}
+
+// heightHint is unused here: btcdb.FetchTxBySha already has its own tx
+// index, unlike ffldbChainDb's block walk in db.go, which needs the hint to
+// avoid starting over at genesis on every call.
+func (c *legacyChainDb) FetchTxByHash(hash *chainhash.Hash, heightHint int64) (*btcwire.MsgTx, error) {
+	sha, err := btcwire.NewShaHash(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	txList, err := c.db.FetchTxBySha(sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(txList) == 0 {
+		return nil, fmt.Errorf("FetchTxBySha(%v) returned no results", sha)
+	}
+	return txList[len(txList)-1].Tx, nil
+}
+
+func (c *legacyChainDb) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/conformal/btclog"
+)
+
+// liveStats holds the counters /stats reports. It's written from the single
+// consumer goroutine driving getSignatures and read from arbitrary HTTP
+// handler goroutines, hence the atomics.
+type liveStats struct {
+	sigCounter int64
+	matches    int64
+	height     int64
+	tipHeight  int64
+}
+
+func (s *liveStats) snapshot() map[string]int64 {
+	return map[string]int64{
+		"sig_counter": atomic.LoadInt64(&s.sigCounter),
+		"matches":     atomic.LoadInt64(&s.matches),
+		"height":      atomic.LoadInt64(&s.height),
+		"tip_height":  atomic.LoadInt64(&s.tipHeight),
+	}
+}
+
+// dupBroadcaster fans newly discovered rData groups out to however many
+// clients are currently connected to /duplicates.
+type dupBroadcaster struct {
+	mu      sync.Mutex
+	clients map[chan []*rData]struct{}
+}
+
+func newDupBroadcaster() *dupBroadcaster {
+	return &dupBroadcaster{clients: make(map[chan []*rData]struct{})}
+}
+
+func (b *dupBroadcaster) subscribe() chan []*rData {
+	ch := make(chan []*rData, 8)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *dupBroadcaster) unsubscribe(ch chan []*rData) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+	close(ch)
+}
+
+func (b *dupBroadcaster) publish(group []*rData) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- group:
+		default:
+			// Slow client; drop rather than block the scanner on it.
+		}
+	}
+}
+
+// serveHTTP exposes /stats (a JSON snapshot of the running scan) and
+// /duplicates (an SSE stream of rData groups as they're discovered), so an
+// operator can leave blockchainr running as a daemon and watch it live.
+func serveHTTP(addr string, stats *liveStats, dups *dupBroadcaster, log btclog.Logger) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.snapshot())
+	})
+
+	mux.HandleFunc("/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch := dups.subscribe()
+		defer dups.unsubscribe(ch)
+
+		for group := range ch {
+			payload, err := json.Marshal(group)
+			if err != nil {
+				log.Warnf("failed to marshal duplicate group: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		}
+	})
+
+	log.Infof("serving /stats and /duplicates on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Warnf("http server failed: %v", err)
+	}
+}
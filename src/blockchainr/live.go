@@ -0,0 +1,59 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/conformal/btclog"
+)
+
+// runLive drives -mode=rpc: unlike the two-pass batch search, it never
+// revisits a block, so there's no bloom filter - every signature's R is
+// tracked directly in rMap, and a group is republished to dups each time a
+// fresh match extends it.
+func runLive(log btclog.Logger, source blockSource, stats *liveStats, dups *dupBroadcaster) {
+	blocks, srcErrs := source.Blocks()
+	signatures := getSignatures(blocks)
+
+	rMap := make(map[string][]*rData)
+
+	for {
+		select {
+		case rd, ok := <-signatures:
+			if !ok {
+				return
+			}
+
+			r := rd.sig.R.String()
+			rMap[r] = append(rMap[r], rd)
+			group := rMap[r]
+
+			atomic.AddInt64(&stats.sigCounter, 1)
+			atomic.StoreInt64(&stats.height, rd.H)
+
+			if len(group) >= 2 {
+				if len(group) == 2 {
+					// Count the match once, when the R first becomes a
+					// duplicate - not again every time it grows further.
+					atomic.AddInt64(&stats.matches, 1)
+				}
+
+				// publish hands group off to the /duplicates SSE goroutine,
+				// which marshals it independently of this loop; send a copy
+				// so a later append here can't race with that marshal.
+				published := append([]*rData(nil), group...)
+				dups.publish(published)
+				log.Infof("nonce reuse detected live: R=%v (%v sigs so far)", r, len(group))
+			}
+
+		case err := <-srcErrs:
+			if err != nil {
+				log.Warnf("rpc source error: %v", err)
+			}
+			return
+		}
+	}
+}
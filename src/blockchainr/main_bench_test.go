@@ -0,0 +1,69 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// benchRCount stands in for the number of signatures step 2 would shard by
+// height ~800k. It's well below the real figure (a full mainnet scan at that
+// height sees on the order of hundreds of millions of inputs), but it's large
+// enough for the per-signature allocation cost this benchmark is about -
+// string-keying vs. rKey-keying - to dominate the result rather than noise.
+const benchRCount = 2000000
+
+// syntheticRs generates benchRCount deterministic, distinct 256-bit R values
+// so both benchmarks below see the same keys in the same order.
+func syntheticRs(n int) []*big.Int {
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 32)
+	rs := make([]*big.Int, n)
+	for i := range rs {
+		rnd.Read(buf)
+		rs[i] = new(big.Int).SetBytes(buf)
+	}
+	return rs
+}
+
+// BenchmarkPotentialValuesStringMap models step 2's pre-sharding approach: a
+// single map[string]struct{} keyed on sig.R.String(), which allocates a
+// decimal string per signature.
+func BenchmarkPotentialValuesStringMap(b *testing.B) {
+	rs := syntheticRs(benchRCount)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seen := make(map[string]struct{}, benchRCount/2)
+		for _, r := range rs {
+			k := r.String()
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+		}
+	}
+}
+
+// BenchmarkPotentialValuesSharded models the current potentialSet: a fixed
+// 32-byte rKey (no per-signature allocation) sharded across rShardCount
+// buckets, the same split step 2's worker pool reads from.
+func BenchmarkPotentialValuesSharded(b *testing.B) {
+	rs := syntheticRs(benchRCount)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set := newPotentialSet()
+		for _, r := range rs {
+			k := newRKey(r)
+			if set.Contains(k) {
+				continue
+			}
+			set.Add(k)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcrpcclient"
+	"github.com/conformal/btcwire"
+)
+
+// rpcSource feeds blocks off a NotifyBlocks subscription against a running
+// btcd, for -mode=rpc: no on-disk db, just whatever the node connects from
+// here on.
+type rpcSource struct {
+	client *btcrpcclient.Client
+	log    btclog.Logger
+
+	blockChan chan *heightBlock
+	errChan   chan error
+}
+
+func newRPCSource(rpcAddr, rpcUser, rpcPass string, log btclog.Logger) (*rpcSource, error) {
+	src := &rpcSource{
+		log:       log,
+		blockChan: make(chan *heightBlock),
+		errChan:   make(chan error, 1),
+	}
+
+	cfg := &btcrpcclient.ConnConfig{
+		Host:         rpcAddr,
+		User:         rpcUser,
+		Pass:         rpcPass,
+		DisableTLS:   true,
+		HTTPPostMode: false,
+	}
+	ntfnHandlers := btcrpcclient.NotificationHandlers{
+		OnBlockConnected: src.onBlockConnected,
+	}
+
+	client, err := btcrpcclient.New(cfg, &ntfnHandlers)
+	if err != nil {
+		return nil, err
+	}
+	src.client = client
+
+	return src, nil
+}
+
+func (s *rpcSource) Blocks() (<-chan *heightBlock, <-chan error) {
+	if err := s.client.NotifyBlocks(); err != nil {
+		s.errChan <- err
+		close(s.blockChan)
+		close(s.errChan)
+	}
+
+	return s.blockChan, s.errChan
+}
+
+// onBlockConnected is the btcrpcclient notification callback; it fetches the
+// full block over RPC and hands it to getSignatures through blockChan.
+func (s *rpcSource) onBlockConnected(hash *btcwire.ShaHash, height int32, t time.Time) {
+	blk, err := s.client.GetBlock(hash)
+	if err != nil {
+		s.log.Warnf("GetBlock(%v) failed: %v", hash, err)
+		return
+	}
+
+	s.blockChan <- &heightBlock{height: int64(height), block: blk.MsgBlock()}
+}
+
+func (s *rpcSource) close() {
+	s.client.Shutdown()
+	s.client.WaitForShutdown()
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Filippo Valsorda
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/conformal/btclog"
+	"github.com/conformal/btcwire"
+)
+
+// heightBlock pairs a fetched block with the height it was fetched at,
+// since database.Tx hands back bare *btcwire.MsgBlock values with no height
+// of their own (unlike the old btcutil.Block wrapper).
+type heightBlock struct {
+	height int64
+	block  *btcwire.MsgBlock
+}
+
+// blockSource feeds getSignatures a stream of blocks to scan, decoupling it
+// from how those blocks were obtained: a one-shot walk over an on-disk db
+// (batchSource) or a live feed from a running btcd (rpcSource, in rpc.go).
+type blockSource interface {
+	// Blocks starts fetching/streaming and returns a channel of blocks,
+	// closed once the source is exhausted or stopped, plus a channel that
+	// receives at most one error if the source fails outright.
+	Blocks() (<-chan *heightBlock, <-chan error)
+}
+
+// batchSource walks a fixed [minHeigth, maxHeigth) range of an on-disk
+// chainDb, the way blockchainr has always scanned in -mode=batch.
+type batchSource struct {
+	db                   chainDb
+	minHeigth, maxHeigth int64
+	log                  btclog.Logger
+}
+
+func (s *batchSource) Blocks() (<-chan *heightBlock, <-chan error) {
+	heigthChan := make(chan int64)
+	blockChan := make(chan *heightBlock)
+	errChan := make(chan error, 1)
+
+	go func() {
+		for h := s.minHeigth; h < s.maxHeigth; h++ {
+			heigthChan <- h
+		}
+
+		close(heigthChan)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i <= 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range heigthChan {
+				hash, err := s.db.FetchBlockHashByHeight(h)
+				if err != nil {
+					s.log.Warnf("failed FetchBlockHashByHeight(%v): %v", h, err)
+					select {
+					case errChan <- err:
+					default:
+					}
+					return
+				}
+				blk, err := s.db.FetchBlockByHash(hash)
+				if err != nil {
+					s.log.Warnf("failed FetchBlockByHash(%v) - h %v: %v", hash, h, err)
+					select {
+					case errChan <- err:
+					default:
+					}
+					return
+				}
+
+				blockChan <- &heightBlock{height: h, block: blk}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(blockChan)
+		close(errChan)
+	}()
+
+	return blockChan, errChan
+}